@@ -1,19 +1,90 @@
 package providers
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
 )
 
+// nextLinkRE extracts the "next" URL from a GitHub API Link header, e.g.
+// `<https://api.github.com/user/orgs?page=2>; rel="next"`.
+// See https://developer.github.com/v3/#pagination
+var nextLinkRE = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+func nextLink(resp *http.Response) string {
+	for _, part := range strings.Split(resp.Header.Get("Link"), ",") {
+		if m := nextLinkRE.FindStringSubmatch(part); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// getPaged GETs endpoint, authenticated as accessToken, and follows its
+// Link: rel="next" header until exhausted, returning the response body of
+// each page in order. Callers unmarshal each page themselves since the
+// result shape varies by endpoint.
+func (p *GitHubProvider) getPaged(endpoint, accessToken string) ([][]byte, error) {
+	var pages [][]byte
+	for endpoint != "" {
+		req, _ := http.NewRequest("GET", endpoint, nil)
+		req.Header.Set("Authorization", "token "+accessToken)
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		resp, err := p.client().Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint, body)
+		}
+
+		pages = append(pages, body)
+		endpoint = nextLink(resp)
+	}
+	return pages, nil
+}
+
+// OrgTeamFilter describes a GitHub org a user may belong to, optionally
+// restricted to one of a set of teams within that org. A filter with no
+// Teams matches on org membership alone.
+type OrgTeamFilter struct {
+	Org   string
+	Teams []string
+}
+
 type GitHubProvider struct {
 	*ProviderData
 	Org  string
 	Team string
+	Orgs []OrgTeamFilter
+
+	// HostName and RootCA configure a GitHub Enterprise (self-hosted)
+	// instance in place of github.com / api.github.com.
+	HostName string
+	RootCA   *x509.CertPool
+
+	// TeamNameField selects how team names are rendered in the groups
+	// claim: "slug" (default), "name", or the combined "org:team" form.
+	TeamNameField string
+	// LoadAllGroups reports every team the user belongs to across all
+	// orgs, rather than only teams within the configured orgs (Org and
+	// Orgs).
+	LoadAllGroups bool
+
+	httpClient *http.Client
 }
 
 func NewGitHubProvider(p *ProviderData) *GitHubProvider {
@@ -48,95 +119,213 @@ func (p *GitHubProvider) SetOrgTeam(org, team string) {
 	p.Org = org
 	p.Team = team
 	if org != "" || team != "" {
-		p.Scope += " read:org"
+		p.requireOrgScope()
 	}
 }
 
-func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
-	// https://developer.github.com/v3/orgs/#list-your-organizations
+// SetOrgs configures a list of org/team filters, any one of which is
+// sufficient to authorize a user. This mirrors SetOrgTeam but allows
+// granting access across several GitHub orgs (and, within an org, several
+// teams) without running multiple proxy instances.
+func (p *GitHubProvider) SetOrgs(orgs []OrgTeamFilter) {
+	p.Orgs = orgs
+	if len(orgs) > 0 {
+		p.requireOrgScope()
+	}
+}
 
-	var orgs []struct {
-		Login string `json:"login"`
+// requireOrgScope adds the read:org scope needed for org/team membership
+// checks, if it isn't already present.
+func (p *GitHubProvider) requireOrgScope() {
+	for _, scope := range strings.Fields(p.Scope) {
+		if scope == "read:org" {
+			return
+		}
 	}
+	p.Scope += " read:org"
+}
 
-	params := url.Values{
-		"access_token": {accessToken},
-		"limit":        {"100"},
+// SetHostName points the provider at a GitHub Enterprise instance instead
+// of github.com, rewriting the login, redeem, validate and API URLs
+// accordingly.
+func (p *GitHubProvider) SetHostName(hostname string) error {
+	if strings.Contains(hostname, "/") {
+		return fmt.Errorf("invalid GitHub hostname %q: must not contain '/'", hostname)
 	}
 
-	endpoint := "https://api.github.com/user/orgs?" + params.Encode()
-	req, _ := http.NewRequest("GET", endpoint, nil)
-	req.Header.Set("Accept", "application/vnd.github.moondragon+json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false, err
+	p.HostName = hostname
+	p.LoginUrl = &url.URL{
+		Scheme: "https",
+		Host:   hostname,
+		Path:   "/login/oauth/authorize",
+	}
+	p.RedeemUrl = &url.URL{
+		Scheme: "https",
+		Host:   hostname,
+		Path:   "/login/oauth/access_token",
+	}
+	p.ValidateUrl = &url.URL{
+		Scheme: "https",
+		Host:   hostname,
+		Path:   "/api/v3/user/emails",
 	}
+	return nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+// SetRootCA loads a PEM-encoded root CA bundle from file, used to validate
+// the TLS certificate of a GitHub Enterprise instance with a private CA,
+// and builds the http.Client used for all subsequent GitHub API calls.
+func (p *GitHubProvider) SetRootCA(file string) error {
+	pem, err := ioutil.ReadFile(file)
 	if err != nil {
-		return false, err
+		return fmt.Errorf("could not read %s: %s", file, err)
 	}
-	if resp.StatusCode != 200 {
-		return false, fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint, body)
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("could not parse any certificates from %s", file)
+	}
+	p.RootCA = pool
+	p.httpClient = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: p.RootCA},
+		},
+	}
+	return nil
+}
+
+// apiBase returns the base URL for the GitHub (Enterprise) API.
+func (p *GitHubProvider) apiBase() string {
+	if p.HostName != "" {
+		return "https://" + p.HostName + "/api/v3"
+	}
+	return "https://api.github.com"
+}
+
+// client returns the http.Client to use for GitHub API calls: the one
+// built by SetRootCA when a custom root CA is configured, or
+// http.DefaultClient otherwise.
+func (p *GitHubProvider) client() *http.Client {
+	if p.httpClient != nil {
+		return p.httpClient
+	}
+	return http.DefaultClient
+}
+
+func (p *GitHubProvider) hasOrg(accessToken, org string) (bool, error) {
+	// https://developer.github.com/v3/orgs/#list-your-organizations
+
+	params := url.Values{
+		"per_page": {"100"},
 	}
 
-	if err := json.Unmarshal(body, &orgs); err != nil {
+	endpoint := p.apiBase() + "/user/orgs?" + params.Encode()
+	pages, err := p.getPaged(endpoint, accessToken)
+	if err != nil {
 		return false, err
 	}
 
-	for _, org := range orgs {
-		if p.Org == org.Login {
-			return true, nil
+	for _, body := range pages {
+		var orgs []struct {
+			Login string `json:"login"`
+		}
+		if err := json.Unmarshal(body, &orgs); err != nil {
+			return false, err
+		}
+		for _, o := range orgs {
+			if org == o.Login {
+				return true, nil
+			}
 		}
 	}
 	return false, nil
 }
 
-func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
+func (p *GitHubProvider) hasOrgAndTeam(accessToken, org string, teams []string) (bool, error) {
 	// https://developer.github.com/v3/orgs/teams/#list-user-teams
 
-	var teams []struct {
-		Name string `json:"name"`
-		Slug string `json:"slug"`
-		Org  struct {
-			Login string `json:"login"`
-		} `json:"organization"`
-	}
-
 	params := url.Values{
-		"access_token": {accessToken},
-		"limit":        {"100"},
+		"per_page": {"100"},
 	}
 
-	endpoint := "https://api.github.com/user/teams?" + params.Encode()
-	req, _ := http.NewRequest("GET", endpoint, nil)
-	req.Header.Set("Accept", "application/vnd.github.moondragon+json")
-	resp, err := http.DefaultClient.Do(req)
+	endpoint := p.apiBase() + "/user/teams?" + params.Encode()
+	pages, err := p.getPaged(endpoint, accessToken)
 	if err != nil {
 		return false, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return false, err
+	for _, body := range pages {
+		var userTeams []struct {
+			Name string `json:"name"`
+			Slug string `json:"slug"`
+			Org  struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}
+		if err := json.Unmarshal(body, &userTeams); err != nil {
+			return false, fmt.Errorf("%s unmarshaling %s", err, body)
+		}
+		for _, team := range userTeams {
+			if org == team.Org.Login {
+				if len(teams) == 0 || contains(teams, team.Slug) {
+					return true, nil
+				}
+			}
+		}
 	}
-	if resp.StatusCode != 200 {
-		return false, fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint, body)
+	return false, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := json.Unmarshal(body, &teams); err != nil {
-		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+// orgFilters returns the configured org/team filters, any one of which is
+// sufficient to authorize a user. It folds the legacy single Org/Team
+// fields in alongside any filters set via SetOrgs.
+func (p *GitHubProvider) orgFilters() []OrgTeamFilter {
+	filters := p.Orgs
+	if p.Org != "" {
+		var teams []string
+		if p.Team != "" {
+			teams = []string{p.Team}
+		}
+		filters = append([]OrgTeamFilter{{Org: p.Org, Teams: teams}}, filters...)
 	}
+	return filters
+}
 
-	for _, team := range teams {
-		if p.Org == team.Org.Login {
-			if p.Team == "" || p.Team == team.Slug {
-				return true, nil
-			}
+// hasAnyOrgAndTeam reports whether accessToken's user satisfies at least one
+// of the configured org/team filters, short-circuiting on the first match.
+// Errors from individual filter checks are aggregated and only returned if
+// no filter matched.
+func (p *GitHubProvider) hasAnyOrgAndTeam(accessToken string) (bool, error) {
+	filters := p.orgFilters()
+	var errs []string
+	for _, f := range filters {
+		var ok bool
+		var err error
+		if len(f.Teams) == 0 {
+			ok, err = p.hasOrg(accessToken, f.Org)
+		} else {
+			ok, err = p.hasOrgAndTeam(accessToken, f.Org, f.Teams)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if ok {
+			return true, nil
 		}
 	}
+	if len(errs) > 0 {
+		return false, fmt.Errorf("error checking GitHub org/team membership: %s", strings.Join(errs, "; "))
+	}
 	return false, nil
 }
 
@@ -148,23 +337,17 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 	}
 
 	// if we require an Org or Team, check that first
-	if p.Org != "" {
-		if p.Team != "" {
-			if ok, err := p.hasOrgAndTeam(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		} else {
-			if ok, err := p.hasOrg(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
+	if len(p.orgFilters()) > 0 {
+		if ok, err := p.hasAnyOrgAndTeam(s.AccessToken); err != nil || !ok {
+			return "", err
 		}
 	}
 
-	params := url.Values{
-		"access_token": {s.AccessToken},
-	}
-	endpoint := "https://api.github.com/user/emails?" + params.Encode()
-	resp, err := http.DefaultClient.Get(endpoint)
+	endpoint := p.apiBase() + "/user/emails"
+	req, _ := http.NewRequest("GET", endpoint, nil)
+	req.Header.Set("Authorization", "token "+s.AccessToken)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	resp, err := p.client().Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -176,8 +359,6 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 
 	if resp.StatusCode != 200 {
 		return "", fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint, body)
-	} else {
-		log.Printf("got %d from %q %s", resp.StatusCode, endpoint, body)
 	}
 
 	if err := json.Unmarshal(body, &emails); err != nil {
@@ -192,3 +373,65 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 
 	return "", errors.New("no email address found")
 }
+
+// GetGroups returns the GitHub teams s's user belongs to, formatted per
+// TeamNameField, for use as a groups claim (e.g. an X-Forwarded-Groups
+// header). Unless LoadAllGroups is set, only teams within the configured
+// org filters (legacy Org, or the Orgs list set via SetOrgs) are returned.
+// Teams are matched on their org only; a filter's Teams list does not narrow
+// the result. With no org filters configured, every team is returned.
+func (p *GitHubProvider) GetGroups(s *SessionState) ([]string, error) {
+	params := url.Values{
+		"per_page": {"100"},
+	}
+
+	endpoint := p.apiBase() + "/user/teams?" + params.Encode()
+	pages, err := p.getPaged(endpoint, s.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := p.orgFilters()
+
+	var groups []string
+	for _, body := range pages {
+		var userTeams []struct {
+			Name string `json:"name"`
+			Slug string `json:"slug"`
+			Org  struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}
+		if err := json.Unmarshal(body, &userTeams); err != nil {
+			return nil, fmt.Errorf("%s unmarshaling %s", err, body)
+		}
+
+		for _, team := range userTeams {
+			if !p.LoadAllGroups && len(filters) > 0 && !orgFiltersContain(filters, team.Org.Login) {
+				continue
+			}
+			groups = append(groups, p.formatTeamName(team.Org.Login, team.Name, team.Slug))
+		}
+	}
+	return groups, nil
+}
+
+func orgFiltersContain(filters []OrgTeamFilter, org string) bool {
+	for _, f := range filters {
+		if f.Org == org {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *GitHubProvider) formatTeamName(org, name, slug string) string {
+	switch p.TeamNameField {
+	case "name":
+		return name
+	case "org:team":
+		return org + ":" + slug
+	default:
+		return slug
+	}
+}
@@ -0,0 +1,175 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestGitHubProvider(server *httptest.Server) *GitHubProvider {
+	p := NewGitHubProvider(&ProviderData{
+		LoginUrl:    &url.URL{},
+		RedeemUrl:   &url.URL{},
+		ProfileUrl:  &url.URL{},
+		ValidateUrl: &url.URL{},
+	})
+	p.HostName = strings.TrimPrefix(server.URL, "https://")
+	p.httpClient = server.Client()
+	return p
+}
+
+func TestNextLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"no link header", "", ""},
+		{"single next link", `<https://api.github.com/user/orgs?page=2>; rel="next"`, "https://api.github.com/user/orgs?page=2"},
+		{"next among others", `<https://api.github.com/user/orgs?page=1>; rel="prev", <https://api.github.com/user/orgs?page=3>; rel="next", <https://api.github.com/user/orgs?page=5>; rel="last"`, "https://api.github.com/user/orgs?page=3"},
+		{"no next link", `<https://api.github.com/user/orgs?page=1>; rel="prev"`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.header != "" {
+				resp.Header.Set("Link", tt.header)
+			}
+			if got := nextLink(resp); got != tt.want {
+				t.Errorf("nextLink() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPaged(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "token my-token" {
+			t.Errorf("Authorization header = %q, want %q", got, "token my-token")
+		}
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `["page2"]`)
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s?page=2>; rel="next"`, "https://"+r.Host+r.URL.Path))
+		fmt.Fprint(w, `["page1"]`)
+	}))
+	defer server.Close()
+
+	p := newTestGitHubProvider(server)
+	pages, err := p.getPaged(server.URL+"/user/orgs", "my-token")
+	if err != nil {
+		t.Fatalf("getPaged() error = %v", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("getPaged() returned %d pages, want 2", len(pages))
+	}
+	if string(pages[0]) != `["page1"]` || string(pages[1]) != `["page2"]` {
+		t.Errorf("getPaged() pages = %q, %q", pages[0], pages[1])
+	}
+}
+
+func TestHasAnyOrgAndTeam(t *testing.T) {
+	teamsRequests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/user/orgs":
+			fmt.Fprint(w, `[{"login":"acme"}]`)
+		case "/api/v3/user/teams":
+			teamsRequests++
+			fmt.Fprint(w, `[{"name":"Engineering","slug":"engineering","organization":{"login":"widgets"}}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("matches org-only filter", func(t *testing.T) {
+		p := newTestGitHubProvider(server)
+		p.SetOrgs([]OrgTeamFilter{{Org: "acme"}})
+		ok, err := p.hasAnyOrgAndTeam("tok")
+		if err != nil || !ok {
+			t.Errorf("hasAnyOrgAndTeam() = %v, %v, want true, nil", ok, err)
+		}
+	})
+
+	t.Run("short-circuits on first match", func(t *testing.T) {
+		p := newTestGitHubProvider(server)
+		p.SetOrgs([]OrgTeamFilter{{Org: "acme"}, {Org: "widgets", Teams: []string{"engineering"}}})
+		teamsRequests = 0
+		ok, err := p.hasAnyOrgAndTeam("tok")
+		if err != nil || !ok {
+			t.Errorf("hasAnyOrgAndTeam() = %v, %v, want true, nil", ok, err)
+		}
+		if teamsRequests != 0 {
+			t.Errorf("hasAnyOrgAndTeam() made %d /user/teams requests after the first filter matched, want 0", teamsRequests)
+		}
+	})
+
+	t.Run("no filter matches", func(t *testing.T) {
+		p := newTestGitHubProvider(server)
+		p.SetOrgs([]OrgTeamFilter{{Org: "other-org"}})
+		ok, err := p.hasAnyOrgAndTeam("tok")
+		if err != nil || ok {
+			t.Errorf("hasAnyOrgAndTeam() = %v, %v, want false, nil", ok, err)
+		}
+	})
+}
+
+func TestFormatTeamName(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"", "engineering"},
+		{"slug", "engineering"},
+		{"name", "Engineering"},
+		{"org:team", "acme:engineering"},
+	}
+
+	for _, tt := range tests {
+		p := &GitHubProvider{TeamNameField: tt.field}
+		if got := p.formatTeamName("acme", "Engineering", "engineering"); got != tt.want {
+			t.Errorf("formatTeamName(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestGetGroups(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"name":"Engineering","slug":"engineering","organization":{"login":"acme"}},
+			{"name":"Security","slug":"security","organization":{"login":"other-org"}}
+		]`)
+	}))
+	defer server.Close()
+
+	t.Run("filters to configured org", func(t *testing.T) {
+		p := newTestGitHubProvider(server)
+		p.SetOrgs([]OrgTeamFilter{{Org: "acme"}})
+		groups, err := p.GetGroups(&SessionState{AccessToken: "tok"})
+		if err != nil {
+			t.Fatalf("GetGroups() error = %v", err)
+		}
+		if len(groups) != 1 || groups[0] != "engineering" {
+			t.Errorf("GetGroups() = %v, want [engineering]", groups)
+		}
+	})
+
+	t.Run("LoadAllGroups returns every org", func(t *testing.T) {
+		p := newTestGitHubProvider(server)
+		p.SetOrgs([]OrgTeamFilter{{Org: "acme"}})
+		p.LoadAllGroups = true
+		groups, err := p.GetGroups(&SessionState{AccessToken: "tok"})
+		if err != nil {
+			t.Fatalf("GetGroups() error = %v", err)
+		}
+		if len(groups) != 2 {
+			t.Errorf("GetGroups() = %v, want 2 groups", groups)
+		}
+	})
+}